@@ -0,0 +1,269 @@
+// Copyright 2017, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/trace"
+	tracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+)
+
+// These are package-level vars rather than consts so tests can shrink
+// them instead of waiting out real reconnect/flush delays.
+var (
+	initialReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff     = 30 * time.Second
+	flushInterval           = 2 * time.Second
+)
+
+// ExportTraceServiceRequest is a batch of spans bound for a single
+// Cloud Trace project, modeled on the OpenCensus Agent's streaming
+// export request.
+type ExportTraceServiceRequest struct {
+	ProjectId string
+	Spans     []*tracepb.Span
+}
+
+// ExportTraceServiceResponse acknowledges an ExportTraceServiceRequest.
+// It carries no fields. The Exporter never calls Recv: reconnects are
+// triggered by Send and Export errors alone.
+type ExportTraceServiceResponse struct{}
+
+// TraceServiceExportStream is the client side of the bidirectional
+// export stream, analogous to the generated stream type for a gRPC
+// streaming RPC.
+type TraceServiceExportStream interface {
+	Send(*ExportTraceServiceRequest) error
+	Recv() (*ExportTraceServiceResponse, error)
+	CloseSend() error
+}
+
+// TraceServiceClient opens the streaming RPC used to upload batches of
+// spans. Implementations are expected to wrap a persistent gRPC
+// connection, reconnecting as needed; the Exporter itself only retries
+// the Export call.
+type TraceServiceClient interface {
+	Export(ctx context.Context) (TraceServiceExportStream, error)
+}
+
+// Stats reports cumulative counters for an Exporter's upload pipeline:
+// spans_dropped_queue_full, spans_exported, and stream_reconnects in
+// Prometheus naming terms. They are plain atomically-updated int64
+// fields read via Stats rather than registered prometheus.Counters, so
+// that this package isn't forced to take a dependency on the Prometheus
+// client library; a caller that wants them exported as real Prometheus
+// metrics can poll Stats and set them on its own counters/gauges.
+type Stats struct {
+	// SpansDroppedQueueFull counts spans discarded by ExportSpan because
+	// the upload queue was full.
+	SpansDroppedQueueFull int64
+
+	// SpansExported counts spans in batches whose Send on the stream
+	// returned no error; responses from Recv are not consulted.
+	SpansExported int64
+
+	// StreamReconnects counts the number of times the upload stream was
+	// (re-)established, including the initial connection.
+	StreamReconnects int64
+}
+
+// Exporter uploads spans to Cloud Trace over a persistent streaming RPC,
+// coalescing converted spans into batches the way the OpenCensus Agent
+// exporter does instead of issuing one RPC per span.
+type Exporter struct {
+	o Options
+
+	spanc chan *tracepb.Span
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	spansDroppedQueueFull int64
+	spansExported         int64
+	streamReconnects      int64
+}
+
+// NewExporter creates an Exporter and starts its background upload
+// goroutine. Callers must call Stop when the exporter is no longer
+// needed so buffered spans are flushed and the upload goroutine exits.
+func NewExporter(o Options) (*Exporter, error) {
+	if o.ProjectID == "" {
+		return nil, fmt.Errorf("stackdriver: ProjectID is required")
+	}
+	if o.Client == nil {
+		return nil, fmt.Errorf("stackdriver: Client is required")
+	}
+	if o.StackCache == nil {
+		o.StackCache = newStackTraceCache()
+	}
+
+	e := &Exporter{
+		o:     o,
+		spanc: make(chan *tracepb.Span, o.queueSize()),
+		done:  make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+// ExportSpan converts s and enqueues it for upload. If the upload queue
+// is full the span is dropped and counted in Stats.SpansDroppedQueueFull
+// rather than blocking the caller.
+func (e *Exporter) ExportSpan(s *trace.SpanData) {
+	sp := protoFromSpanData(s, e.o.ProjectID, e.o)
+	select {
+	case e.spanc <- sp:
+	default:
+		atomic.AddInt64(&e.spansDroppedQueueFull, 1)
+	}
+}
+
+// Stop flushes any buffered spans and stops the upload goroutine. It
+// does not return until the goroutine has exited.
+func (e *Exporter) Stop() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+// Stats returns a snapshot of the exporter's cumulative counters.
+func (e *Exporter) Stats() Stats {
+	return Stats{
+		SpansDroppedQueueFull: atomic.LoadInt64(&e.spansDroppedQueueFull),
+		SpansExported:         atomic.LoadInt64(&e.spansExported),
+		StreamReconnects:      atomic.LoadInt64(&e.streamReconnects),
+	}
+}
+
+// run batches converted spans read from spanc and uploads them over a
+// reconnecting stream until Stop is called.
+func (e *Exporter) run() {
+	defer e.wg.Done()
+
+	var stream TraceServiceExportStream
+	reconnect := func() {
+		s, err := e.o.Client.Export(context.Background())
+		if err != nil {
+			stream = nil
+			return
+		}
+		stream = s
+		atomic.AddInt64(&e.streamReconnects, 1)
+	}
+	reconnect()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	maxSpans := e.o.maxSpansPerBatch()
+	maxBytes := e.o.maxBatchBytes()
+
+	var batch []*tracepb.Span
+	var batchBytes int
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// Each ExportTraceServiceRequest is its own hash-reference scope
+		// as far as Cloud Trace is concerned, so the dedup cache must
+		// start empty for every batch: collapse repeats within this
+		// batch to a hash reference, then reset for the next one.
+		e.o.StackCache.reset()
+		for _, sp := range batch {
+			dedupeStackTrace(sp, e.o.StackCache)
+		}
+		req := &ExportTraceServiceRequest{ProjectId: e.o.ProjectID, Spans: batch}
+		backoff := initialReconnectBackoff
+		for {
+			if stream != nil {
+				if err := stream.Send(req); err == nil {
+					break
+				}
+				stream.CloseSend()
+				stream = nil
+			}
+			select {
+			case <-e.done:
+				return
+			case <-time.After(backoff):
+			}
+			reconnect()
+			if stream == nil {
+				backoff *= 2
+				if backoff > maxReconnectBackoff {
+					backoff = maxReconnectBackoff
+				}
+			} else {
+				backoff = initialReconnectBackoff
+			}
+		}
+		atomic.AddInt64(&e.spansExported, int64(len(batch)))
+		batch = nil
+		batchBytes = 0
+	}
+
+	for {
+		select {
+		case sp, ok := <-e.spanc:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, sp)
+			batchBytes += proto.Size(sp)
+			if len(batch) >= maxSpans || batchBytes >= maxBytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case sp := <-e.spanc:
+					batch = append(batch, sp)
+					batchBytes += proto.Size(sp)
+					if len(batch) >= maxSpans || batchBytes >= maxBytes {
+						flush()
+					}
+				default:
+					flush()
+					if stream != nil {
+						stream.CloseSend()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// dedupeStackTrace collapses sp's stack trace to a bare StackTraceHashId
+// if an identical stack has already been seen earlier in the same batch
+// via cache, leaving the full StackFrames payload on the first
+// occurrence only.
+func dedupeStackTrace(sp *tracepb.Span, cache *stackTraceCache) {
+	if sp.StackTrace == nil {
+		return
+	}
+	if cache.sawHash(uint64(sp.StackTrace.StackTraceHashId)) {
+		sp.StackTrace = &tracepb.StackTrace{StackTraceHashId: sp.StackTrace.StackTraceHashId}
+	}
+}
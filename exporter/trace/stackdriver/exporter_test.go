@@ -0,0 +1,192 @@
+// Copyright 2017, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	tracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+)
+
+// fakeExportStream records every request sent to it and can be made to
+// fail sends on demand.
+type fakeExportStream struct {
+	mu      sync.Mutex
+	sent    []*ExportTraceServiceRequest
+	sendErr error
+}
+
+func (s *fakeExportStream) Send(req *ExportTraceServiceRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	s.sent = append(s.sent, req)
+	return nil
+}
+
+func (s *fakeExportStream) Recv() (*ExportTraceServiceResponse, error) {
+	return &ExportTraceServiceResponse{}, nil
+}
+
+func (s *fakeExportStream) CloseSend() error { return nil }
+
+func (s *fakeExportStream) requests() []*ExportTraceServiceRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*ExportTraceServiceRequest, len(s.sent))
+	copy(out, s.sent)
+	return out
+}
+
+// fakeTraceServiceClient fails the first failCount calls to Export, then
+// hands back stream for every call after that.
+type fakeTraceServiceClient struct {
+	mu        sync.Mutex
+	failCount int
+	calls     int
+	stream    TraceServiceExportStream
+}
+
+func (c *fakeTraceServiceClient) Export(ctx context.Context) (TraceServiceExportStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.calls <= c.failCount {
+		return nil, errors.New("fake: connect failure")
+	}
+	return c.stream, nil
+}
+
+// useFastTimers shrinks the package's reconnect/flush timing for the
+// duration of a test so it doesn't have to wait out real-world delays.
+func useFastTimers(t *testing.T) {
+	t.Helper()
+	origInit, origMax, origFlush := initialReconnectBackoff, maxReconnectBackoff, flushInterval
+	initialReconnectBackoff = 5 * time.Millisecond
+	maxReconnectBackoff = 20 * time.Millisecond
+	flushInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		initialReconnectBackoff, maxReconnectBackoff, flushInterval = origInit, origMax, origFlush
+	})
+}
+
+func waitForStat(t *testing.T, e *Exporter, want int64, get func(Stats) int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if get(e.Stats()) >= want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for stat to reach %d, got %d", want, get(e.Stats()))
+}
+
+func TestExporterCoalescesBatchesUpToMaxSpansPerBatch(t *testing.T) {
+	useFastTimers(t)
+	stream := &fakeExportStream{}
+	client := &fakeTraceServiceClient{stream: stream}
+	e, err := NewExporter(Options{ProjectID: "proj", Client: client, MaxSpansPerBatch: 2})
+	if err != nil {
+		t.Fatalf("NewExporter: %v", err)
+	}
+	defer e.Stop()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		e.ExportSpan(&trace.SpanData{Name: fmt.Sprintf("span-%d", i)})
+	}
+
+	waitForStat(t, e, n, func(s Stats) int64 { return s.SpansExported })
+
+	reqs := stream.requests()
+	for _, req := range reqs {
+		if got := len(req.Spans); got > 2 {
+			t.Errorf("batch has %d spans, want <= MaxSpansPerBatch (2)", got)
+		}
+	}
+}
+
+func TestExporterReconnectsWithBackoffAfterConnectFailure(t *testing.T) {
+	useFastTimers(t)
+	stream := &fakeExportStream{}
+	client := &fakeTraceServiceClient{stream: stream, failCount: 2}
+	e, err := NewExporter(Options{ProjectID: "proj", Client: client, MaxSpansPerBatch: 1})
+	if err != nil {
+		t.Fatalf("NewExporter: %v", err)
+	}
+	defer e.Stop()
+
+	e.ExportSpan(&trace.SpanData{Name: "span"})
+
+	waitForStat(t, e, 1, func(s Stats) int64 { return s.SpansExported })
+
+	stats := e.Stats()
+	if stats.StreamReconnects < 1 {
+		t.Errorf("StreamReconnects = %d, want >= 1", stats.StreamReconnects)
+	}
+	if len(stream.requests()) != 1 {
+		t.Errorf("len(requests) = %d, want 1", len(stream.requests()))
+	}
+}
+
+func TestExporterDropsSpansWhenQueueIsFull(t *testing.T) {
+	// Constructed directly (rather than via NewExporter) so no upload
+	// goroutine drains spanc out from under the test.
+	e := &Exporter{
+		o:     Options{ProjectID: "proj"},
+		spanc: make(chan *tracepb.Span, 1),
+		done:  make(chan struct{}),
+	}
+
+	e.ExportSpan(&trace.SpanData{Name: "fills-the-queue"})
+	e.ExportSpan(&trace.SpanData{Name: "dropped"})
+
+	if got := e.Stats().SpansDroppedQueueFull; got != 1 {
+		t.Errorf("SpansDroppedQueueFull = %d, want 1", got)
+	}
+	if got := e.Stats().SpansExported; got != 0 {
+		t.Errorf("SpansExported = %d, want 0 (no upload goroutine running)", got)
+	}
+}
+
+func TestExporterFlushesBufferedSpansOnStop(t *testing.T) {
+	useFastTimers(t)
+	stream := &fakeExportStream{}
+	client := &fakeTraceServiceClient{stream: stream}
+	// MaxSpansPerBatch larger than the number of spans sent, so only the
+	// flush triggered by Stop's shutdown drain should export them.
+	e, err := NewExporter(Options{ProjectID: "proj", Client: client, MaxSpansPerBatch: 100})
+	if err != nil {
+		t.Fatalf("NewExporter: %v", err)
+	}
+
+	e.ExportSpan(&trace.SpanData{Name: "a"})
+	e.ExportSpan(&trace.SpanData{Name: "b"})
+
+	e.Stop()
+
+	if got := e.Stats().SpansExported; got != 2 {
+		t.Errorf("SpansExported after Stop = %d, want 2", got)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+// AttributeProcessor lets callers rewrite or redact attributes before
+// they are exported. The exporter invokes Process for every attribute
+// on every span, annotation, and link, in the map iteration order of the
+// originating trace.SpanData/Annotation/Link. Process returns the
+// (possibly unchanged) key and value to export, or drop set to discard
+// the attribute entirely.
+type AttributeProcessor interface {
+	Process(key string, value interface{}) (newKey string, newValue interface{}, drop bool)
+}
+
+// AttributeProcessorFunc adapts a function to an AttributeProcessor.
+type AttributeProcessorFunc func(key string, value interface{}) (string, interface{}, bool)
+
+// Process calls f(key, value).
+func (f AttributeProcessorFunc) Process(key string, value interface{}) (string, interface{}, bool) {
+	return f(key, value)
+}
+
+// ChainProcessors returns an AttributeProcessor that runs procs in order,
+// feeding each one's output to the next. It stops early and drops the
+// attribute if any processor in the chain does.
+func ChainProcessors(procs ...AttributeProcessor) AttributeProcessor {
+	return AttributeProcessorFunc(func(key string, value interface{}) (string, interface{}, bool) {
+		for _, p := range procs {
+			var drop bool
+			key, value, drop = p.Process(key, value)
+			if drop {
+				return key, value, true
+			}
+		}
+		return key, value, false
+	})
+}
+
+// RegexRedactor redacts string attribute values by replacing every match
+// of Pattern with Replacement. Non-string values and keys are passed
+// through unchanged.
+type RegexRedactor struct {
+	// Pattern is matched against string attribute values.
+	Pattern *regexp.Regexp
+
+	// Replacement is substituted for each match, following the semantics
+	// of regexp.Regexp.ReplaceAllString (so "$1"-style references to
+	// Pattern's capture groups are supported). Defaults to "REDACTED" if
+	// empty.
+	Replacement string
+}
+
+// Process implements AttributeProcessor.
+func (r *RegexRedactor) Process(key string, value interface{}) (string, interface{}, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return key, value, false
+	}
+	replacement := r.Replacement
+	if replacement == "" {
+		replacement = "REDACTED"
+	}
+	return key, r.Pattern.ReplaceAllString(s, replacement), false
+}
+
+// SHA256Hasher replaces string attribute values with the hex-encoded
+// SHA-256 hash of their UTF-8 bytes, e.g. to avoid exporting raw user
+// identifiers while still letting them be correlated across spans.
+type SHA256Hasher struct {
+	// Keys selects which attribute keys are hashed. A nil or empty Keys
+	// hashes every string attribute.
+	Keys map[string]bool
+}
+
+// Process implements AttributeProcessor.
+func (h *SHA256Hasher) Process(key string, value interface{}) (string, interface{}, bool) {
+	if len(h.Keys) > 0 && !h.Keys[key] {
+		return key, value, false
+	}
+	s, ok := value.(string)
+	if !ok {
+		return key, value, false
+	}
+	sum := sha256.Sum256([]byte(s))
+	return key, hex.EncodeToString(sum[:]), false
+}
+
+// KeySanitizer rewrites attribute keys to conform to Cloud Trace's
+// recommended [a-z][a-z0-9_./-]* key format, so that attribute keys are
+// normalized the same way whether they originate from traces or metrics.
+// Values are passed through unchanged.
+type KeySanitizer struct{}
+
+// Process implements AttributeProcessor.
+func (KeySanitizer) Process(key string, value interface{}) (string, interface{}, bool) {
+	return sanitizeAttributeKey(key), value, false
+}
+
+// sanitizeAttributeKey rewrites key to match Cloud Trace's recommended
+// [a-z][a-z0-9_./-]* attribute key format: uppercase letters are
+// lowercased, any other disallowed character becomes '_', and a key that
+// doesn't start with a letter is given an "a_" prefix.
+func sanitizeAttributeKey(key string) string {
+	if key == "" {
+		return key
+	}
+	out := make([]byte, len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			out[i] = c
+		case c >= 'A' && c <= 'Z':
+			out[i] = c - 'A' + 'a'
+		case c >= '0' && c <= '9', c == '_', c == '.', c == '/', c == '-':
+			out[i] = c
+		default:
+			out[i] = '_'
+		}
+	}
+	s := string(out)
+	if s[0] < 'a' || s[0] > 'z' {
+		s = "a_" + s
+	}
+	return s
+}
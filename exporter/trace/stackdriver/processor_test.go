@@ -0,0 +1,181 @@
+// Copyright 2017, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"regexp"
+	"testing"
+
+	tracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+)
+
+func TestRegexRedactorReplacesMatches(t *testing.T) {
+	r := &RegexRedactor{Pattern: regexp.MustCompile(`\d+`)}
+
+	key, value, drop := r.Process("ssn", "user-12345")
+	if drop {
+		t.Fatal("RegexRedactor should never drop an attribute")
+	}
+	if key != "ssn" {
+		t.Errorf("key = %q, want unchanged %q", key, "ssn")
+	}
+	if value != "user-REDACTED" {
+		t.Errorf("value = %q, want %q", value, "user-REDACTED")
+	}
+}
+
+func TestRegexRedactorCustomReplacement(t *testing.T) {
+	r := &RegexRedactor{Pattern: regexp.MustCompile(`\d+`), Replacement: "#"}
+
+	_, value, _ := r.Process("ssn", "user-12345")
+	if value != "user-#" {
+		t.Errorf("value = %q, want %q", value, "user-#")
+	}
+}
+
+func TestRegexRedactorIgnoresNonStringValues(t *testing.T) {
+	r := &RegexRedactor{Pattern: regexp.MustCompile(`\d+`)}
+
+	_, value, drop := r.Process("count", int64(12345))
+	if drop {
+		t.Fatal("RegexRedactor should never drop an attribute")
+	}
+	if value != int64(12345) {
+		t.Errorf("value = %v, want unchanged int64(12345)", value)
+	}
+}
+
+func TestSHA256HasherHashesSelectedKeys(t *testing.T) {
+	h := &SHA256Hasher{Keys: map[string]bool{"email": true}}
+
+	key, value, drop := h.Process("email", "user@example.com")
+	if drop {
+		t.Fatal("SHA256Hasher should never drop an attribute")
+	}
+	if key != "email" {
+		t.Errorf("key = %q, want unchanged %q", key, "email")
+	}
+	wantHash := "b4c9a289323b21a01c3e940f150eb9b8c542587f1abfd8f0e1cc1ffc5e475514"
+	if value != wantHash {
+		t.Errorf("value = %q, want %q", value, wantHash)
+	}
+
+	if _, value, _ := h.Process("other", "untouched"); value != "untouched" {
+		t.Errorf("unselected key was hashed: value = %v, want unchanged", value)
+	}
+}
+
+func TestSHA256HasherNilKeysHashesEverything(t *testing.T) {
+	h := &SHA256Hasher{}
+
+	_, value, _ := h.Process("anything", "secret")
+	if value == "secret" {
+		t.Error("SHA256Hasher with nil Keys should hash every string attribute")
+	}
+}
+
+func TestSHA256HasherIgnoresNonStringValues(t *testing.T) {
+	h := &SHA256Hasher{}
+
+	_, value, drop := h.Process("count", int64(42))
+	if drop {
+		t.Fatal("SHA256Hasher should never drop an attribute")
+	}
+	if value != int64(42) {
+		t.Errorf("value = %v, want unchanged int64(42)", value)
+	}
+}
+
+func TestKeySanitizerNormalizesKeys(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"already_ok", "already_ok"},
+		{"Http.Status", "http.status"},
+		{"my key!", "my_key_"},
+		{"1start", "a_1start"},
+	}
+	for _, tt := range tests {
+		key, value, drop := KeySanitizer{}.Process(tt.in, "v")
+		if drop {
+			t.Fatalf("KeySanitizer.Process(%q): should never drop an attribute", tt.in)
+		}
+		if key != tt.want {
+			t.Errorf("KeySanitizer.Process(%q) key = %q, want %q", tt.in, key, tt.want)
+		}
+		if value != "v" {
+			t.Errorf("KeySanitizer.Process(%q) value = %v, want unchanged", tt.in, value)
+		}
+	}
+}
+
+func TestChainProcessorsRunsInOrder(t *testing.T) {
+	upper := AttributeProcessorFunc(func(key string, value interface{}) (string, interface{}, bool) {
+		return key + ".1", value, false
+	})
+	lower := AttributeProcessorFunc(func(key string, value interface{}) (string, interface{}, bool) {
+		return key + ".2", value, false
+	})
+	chain := ChainProcessors(upper, lower)
+
+	key, _, drop := chain.Process("k", "v")
+	if drop {
+		t.Fatal("ChainProcessors should not drop when no processor in the chain drops")
+	}
+	if key != "k.1.2" {
+		t.Errorf("key = %q, want %q (processors applied in order)", key, "k.1.2")
+	}
+}
+
+func TestChainProcessorsStopsAtFirstDrop(t *testing.T) {
+	dropper := AttributeProcessorFunc(func(key string, value interface{}) (string, interface{}, bool) {
+		return key, value, true
+	})
+	never := AttributeProcessorFunc(func(key string, value interface{}) (string, interface{}, bool) {
+		t.Fatal("ChainProcessors should not call processors after one drops")
+		return key, value, false
+	})
+	chain := ChainProcessors(dropper, never)
+
+	_, _, drop := chain.Process("k", "v")
+	if !drop {
+		t.Error("ChainProcessors should drop once any processor in the chain drops")
+	}
+}
+
+func TestCopyAttributesInvokesProcessor(t *testing.T) {
+	proc := AttributeProcessorFunc(func(key string, value interface{}) (string, interface{}, bool) {
+		if key == "secret" {
+			return key, value, true
+		}
+		return key + ".processed", value, false
+	})
+
+	var attrs *tracepb.Span_Attributes
+	copyAttributes(&attrs, map[string]interface{}{
+		"secret": "drop-me",
+		"public": int64(1),
+	}, proc)
+
+	if _, ok := attrs.AttributeMap["secret"]; ok {
+		t.Error("copyAttributes exported an attribute the processor dropped")
+	}
+	if _, ok := attrs.AttributeMap["secret.processed"]; ok {
+		t.Error("copyAttributes exported an attribute the processor dropped")
+	}
+	if _, ok := attrs.AttributeMap["public.processed"]; !ok {
+		t.Error("copyAttributes did not export the processor's rewritten key")
+	}
+}
@@ -15,9 +15,14 @@
 package stackdriver
 
 import (
+	"encoding/base64"
 	"fmt"
+	"hash/fnv"
 	"math"
 	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -31,10 +36,111 @@ import (
 const (
 	maxAnnotationEventsPerSpan = 32
 	maxMessageEventsPerSpan    = 128
+
+	// maxAttributesPerSpan is Cloud Trace's limit on the number of attributes
+	// a single span, annotation, or link may carry. Flattened slice
+	// attributes count each flattened key against this limit.
+	maxAttributesPerSpan = 32
+
+	// maxStackFrames is the number of real frames kept from a stack trace
+	// that is deeper than this; such a stack is exported with one extra
+	// synthetic marker frame standing in for the frames dropped from its
+	// middle (see buildStackTrace).
+	maxStackFrames = 128
+
+	// DefaultMaxLinksPerSpan is the MaxLinksPerSpan used when Options.MaxLinksPerSpan
+	// is unset, matching Cloud Trace's own per-span link limit.
+	DefaultMaxLinksPerSpan = 128
+
+	// DefaultMaxSpansPerBatch is the MaxSpansPerBatch used when
+	// Options.MaxSpansPerBatch is unset.
+	DefaultMaxSpansPerBatch = 200
+
+	// DefaultMaxBatchBytes is the MaxBatchBytes used when
+	// Options.MaxBatchBytes is unset.
+	DefaultMaxBatchBytes = 1 << 20 // 1 MiB
+
+	// DefaultQueueSize is the QueueSize used when Options.QueueSize is
+	// unset.
+	DefaultQueueSize = 4096
 )
 
+// Options controls how protoFromSpanData converts a trace.SpanData into
+// its Cloud Trace proto representation, and how an Exporter built from
+// those Options batches and uploads the result. The zero value is ready
+// to use with protoFromSpanData and selects the package defaults;
+// NewExporter additionally requires ProjectID and Client.
+type Options struct {
+	// ProjectID is the Google Cloud Platform project under which spans are
+	// uploaded. Required by NewExporter.
+	ProjectID string
+
+	// Client is used to stream converted spans to Cloud Trace. Required by
+	// NewExporter.
+	Client TraceServiceClient
+
+	// MaxLinksPerSpan caps the number of links copied from a span. Zero
+	// selects DefaultMaxLinksPerSpan.
+	MaxLinksPerSpan int
+
+	// StackCache is used by Exporter to deduplicate stack traces across
+	// the spans in a single export batch, resetting it before every
+	// flush. Nil (the default) has NewExporter allocate one;
+	// protoFromSpanData does not consult it directly.
+	StackCache *stackTraceCache
+
+	// MaxSpansPerBatch caps the number of spans coalesced into a single
+	// ExportTraceServiceRequest. Zero selects DefaultMaxSpansPerBatch.
+	MaxSpansPerBatch int
+
+	// MaxBatchBytes caps the approximate serialized size of a single
+	// ExportTraceServiceRequest. Zero selects DefaultMaxBatchBytes.
+	MaxBatchBytes int
+
+	// QueueSize bounds the number of converted spans buffered between
+	// ExportSpan and the upload goroutine. Zero selects DefaultQueueSize;
+	// spans offered once the queue is full are dropped and counted in
+	// Exporter.Stats.SpansDroppedQueueFull.
+	QueueSize int
+
+	// AttributeProcessor, when set, is invoked for every attribute on
+	// every span, annotation, and link before it is truncated and
+	// converted to an AttributeValue. It lets callers redact secrets,
+	// hash identifiers, or rewrite keys to conform to Cloud Trace's
+	// [a-z][a-z0-9_./-]* recommendation. Nil leaves attributes untouched.
+	AttributeProcessor AttributeProcessor
+}
+
+func (o Options) maxLinksPerSpan() int {
+	if o.MaxLinksPerSpan <= 0 {
+		return DefaultMaxLinksPerSpan
+	}
+	return o.MaxLinksPerSpan
+}
+
+func (o Options) maxSpansPerBatch() int {
+	if o.MaxSpansPerBatch <= 0 {
+		return DefaultMaxSpansPerBatch
+	}
+	return o.MaxSpansPerBatch
+}
+
+func (o Options) maxBatchBytes() int {
+	if o.MaxBatchBytes <= 0 {
+		return DefaultMaxBatchBytes
+	}
+	return o.MaxBatchBytes
+}
+
+func (o Options) queueSize() int {
+	if o.QueueSize <= 0 {
+		return DefaultQueueSize
+	}
+	return o.QueueSize
+}
+
 // proto returns a protocol buffer representation of a SpanData.
-func protoFromSpanData(s *trace.SpanData, projectID string) *tracepb.Span {
+func protoFromSpanData(s *trace.SpanData, projectID string, o Options) *tracepb.Span {
 	if s == nil {
 		return nil
 	}
@@ -58,7 +164,7 @@ func protoFromSpanData(s *trace.SpanData, projectID string) *tracepb.Span {
 	}
 
 	var annotations, droppedAnnotationsCount, messageEvents, droppedMessageEventsCount int
-	copyAttributes(&sp.Attributes, s.Attributes)
+	copyAttributes(&sp.Attributes, s.Attributes, o.AttributeProcessor)
 
 	as := s.Annotations
 	for i, a := range as {
@@ -67,7 +173,7 @@ func protoFromSpanData(s *trace.SpanData, projectID string) *tracepb.Span {
 			break
 		}
 		annotation := &tracepb.Span_TimeEvent_Annotation{Description: trunc(a.Message, 256)}
-		copyAttributes(&annotation.Attributes, a.Attributes)
+		copyAttributes(&annotation.Attributes, a.Attributes, o.AttributeProcessor)
 		event := &tracepb.Span_TimeEvent{
 			Time:  timestampProto(a.Time),
 			Value: &tracepb.Span_TimeEvent_Annotation_{Annotation: annotation},
@@ -111,41 +217,27 @@ func protoFromSpanData(s *trace.SpanData, projectID string) *tracepb.Span {
 	}
 
 	if pcs := s.StackTrace; pcs != nil {
-		sf := &tracepb.StackTrace_StackFrames{}
-		sp.StackTrace = &tracepb.StackTrace{StackFrames: sf}
-		frames := runtime.CallersFrames(pcs)
-		dropped := 0
-		for {
-			frame, more := frames.Next()
-			if len(sf.Frame) >= 128 {
-				// TODO: drop from the middle
-				dropped++
-			} else {
-				sf.Frame = append(sf.Frame, &tracepb.StackTrace_StackFrame{
-					FunctionName: trunc(frame.Function, 1024),
-					FileName:     trunc(frame.File, 256),
-					LineNumber:   int64(frame.Line),
-				})
-			}
-			if !more {
-				break
-			}
-		}
-		sf.DroppedFramesCount = clip32(dropped)
+		sp.StackTrace = buildStackTrace(pcs)
 	}
 
-	if len(s.Links) > 0 {
+	if ls := s.Links; len(ls) > 0 {
+		maxLinks := o.maxLinksPerSpan()
 		sp.Links = &tracepb.Span_Links{}
-		sp.Links.Link = make([]*tracepb.Span_Link, 0, len(s.Links))
-		for _, l := range s.Links {
+		n := len(ls)
+		if n > maxLinks {
+			n = maxLinks
+		}
+		sp.Links.Link = make([]*tracepb.Span_Link, 0, n)
+		for _, l := range ls[:n] {
 			link := &tracepb.Span_Link{
 				TraceId: fmt.Sprintf("projects/%s/traces/%s", projectID, l.TraceID),
 				SpanId:  l.SpanID.String(),
 				Type:    tracepb.Span_Link_Type(l.Type),
 			}
-			copyAttributes(&link.Attributes, l.Attributes)
+			copyAttributes(&link.Attributes, l.Attributes, o.AttributeProcessor)
 			sp.Links.Link = append(sp.Links.Link, link)
 		}
+		sp.Links.DroppedLinksCount = clip32(len(ls) - n)
 	}
 
 	return sp
@@ -161,7 +253,25 @@ func timestampProto(t time.Time) *timestamppb.Timestamp {
 
 // copyAttributes copies a map of attributes to a proto map field.
 // It creates the map if it is nil.
-func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}) {
+//
+// If proc is non-nil it is given the first look at every key/value pair
+// and may rewrite the key, rewrite the value, or drop the attribute
+// entirely; see AttributeProcessor. What survives is then converted:
+// bool, int64, and string values map directly onto the corresponding
+// AttributeValue variant. float64 values have no native Cloud Trace
+// representation, so they are rounded to the nearest int64 (the
+// truncation policy) and the untruncated value is preserved alongside it
+// as a string attribute under "<key>.value". []byte values are base64
+// encoded into a string attribute. []string, []int64, []bool, and
+// []float64 slices are flattened into indexed "<key>.0", "<key>.1", ...
+// attributes plus a "<key>.length" counter, since Cloud Trace has no
+// native list attribute type. Any attribute, flattened or not, that would
+// push the span over Cloud Trace's maxAttributesPerSpan cap is dropped
+// and counted in DroppedAttributesCount instead. Callers that invoke
+// copyAttributes more than once against the same *out (e.g. to layer a
+// synthetic attribute on top of a span's real ones) get an accumulated
+// DroppedAttributesCount rather than having the later call overwrite it.
+func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}, proc AttributeProcessor) {
 	if len(in) == 0 {
 		return
 	}
@@ -172,25 +282,72 @@ func copyAttributes(out **tracepb.Span_Attributes, in map[string]interface{}) {
 		(*out).AttributeMap = make(map[string]*tracepb.AttributeValue)
 	}
 	var dropped int32
+	set := func(key string, value *tracepb.AttributeValue) {
+		if len(key) > 128 {
+			dropped++
+			return
+		}
+		if len((*out).AttributeMap) >= maxAttributesPerSpan {
+			dropped++
+			return
+		}
+		(*out).AttributeMap[key] = value
+	}
+	boolValue := func(v bool) *tracepb.AttributeValue {
+		return &tracepb.AttributeValue{Value: &tracepb.AttributeValue_BoolValue{BoolValue: v}}
+	}
+	intValue := func(v int64) *tracepb.AttributeValue {
+		return &tracepb.AttributeValue{Value: &tracepb.AttributeValue_IntValue{IntValue: v}}
+	}
+	stringValue := func(v string) *tracepb.AttributeValue {
+		return &tracepb.AttributeValue{Value: &tracepb.AttributeValue_StringValue{StringValue: trunc(v, 256)}}
+	}
 	for key, value := range in {
-		av := tracepb.AttributeValue{}
+		if proc != nil {
+			var drop bool
+			key, value, drop = proc.Process(key, value)
+			if drop {
+				continue
+			}
+		}
 		switch value := value.(type) {
 		case bool:
-			av.Value = &tracepb.AttributeValue_BoolValue{BoolValue: value}
+			set(key, boolValue(value))
 		case int64:
-			av.Value = &tracepb.AttributeValue_IntValue{IntValue: value}
+			set(key, intValue(value))
 		case string:
-			av.Value = &tracepb.AttributeValue_StringValue{StringValue: trunc(value, 256)}
+			set(key, stringValue(value))
+		case float64:
+			set(key, intValue(int64(math.Round(value))))
+			set(key+".value", stringValue(strconv.FormatFloat(value, 'g', -1, 64)))
+		case []byte:
+			set(key, stringValue(base64.StdEncoding.EncodeToString(value)))
+		case []string:
+			set(key+".length", intValue(int64(len(value))))
+			for i, v := range value {
+				set(fmt.Sprintf("%s.%d", key, i), stringValue(v))
+			}
+		case []int64:
+			set(key+".length", intValue(int64(len(value))))
+			for i, v := range value {
+				set(fmt.Sprintf("%s.%d", key, i), intValue(v))
+			}
+		case []bool:
+			set(key+".length", intValue(int64(len(value))))
+			for i, v := range value {
+				set(fmt.Sprintf("%s.%d", key, i), boolValue(v))
+			}
+		case []float64:
+			set(key+".length", intValue(int64(len(value))))
+			for i, v := range value {
+				// Same rounding truncation policy as the scalar float64 case.
+				set(fmt.Sprintf("%s.%d", key, i), intValue(int64(math.Round(v))))
+			}
 		default:
 			continue
 		}
-		if len(key) > 128 {
-			dropped++
-			continue
-		}
-		(*out).AttributeMap[key] = &av
 	}
-	(*out).DroppedAttributesCount = dropped
+	(*out).DroppedAttributesCount += dropped
 }
 
 // trunc returns a TruncatableString truncated to the given limit.
@@ -226,3 +383,169 @@ func clip32(x int) int32 {
 	}
 	return int32(x)
 }
+
+// stackTraceCache deduplicates stack traces across the spans in a single
+// export batch. Cloud Trace accepts a StackTraceHashId in place of a full
+// StackFrames payload for any hash it has already seen earlier in the
+// same CreateSpan/BatchWriteSpans call, so repeated identical stacks (a
+// very common case for spans created from the same call site) only need
+// to be serialized once per call.
+//
+// A stackTraceCache's seen set only ever grows, so it must be reset (see
+// reset) before each export batch — it is the Exporter's job to do this
+// in flush, since protoFromSpanData itself has no notion of batch
+// boundaries. Using a cache across multiple batches without resetting it
+// would make every batch after the first omit StackFrames for any stack
+// seen in an earlier, already-sent batch, which Cloud Trace cannot
+// resolve a hash reference against.
+type stackTraceCache struct {
+	mu   sync.Mutex
+	seen map[uint64]bool
+}
+
+func newStackTraceCache() *stackTraceCache {
+	return &stackTraceCache{seen: make(map[uint64]bool)}
+}
+
+// sawHash reports whether hash has already been recorded, recording it if
+// not.
+func (c *stackTraceCache) sawHash(hash uint64) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen[hash] {
+		return true
+	}
+	c.seen[hash] = true
+	return false
+}
+
+// reset clears the set of seen hashes, making c ready for reuse in the
+// next export batch.
+func (c *stackTraceCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.seen {
+		delete(c.seen, k)
+	}
+}
+
+// buildStackTrace converts the call stack in pcs to a tracepb.StackTrace,
+// applying Cloud Trace's maxStackFrames cap with a middle-drop strategy:
+// deep recursion tends to push the frame that actually faulted off of a
+// naive tail-truncated stack, so the first and last halves of the stack
+// are kept and the frames in between are collapsed into a single
+// synthetic marker frame.
+//
+// The returned StackTrace always carries a full StackFrames payload;
+// hash-reference deduplication against a stackTraceCache happens later,
+// once spans are grouped into an export batch (see the flush closure in
+// Exporter.run).
+func buildStackTrace(pcs []uintptr) *tracepb.StackTrace {
+	frameIter := runtime.CallersFrames(pcs)
+	var frames []runtime.Frame
+	for {
+		frame, more := frameIter.Next()
+		frames = append(frames, frame)
+		if !more {
+			break
+		}
+	}
+
+	hash := hashFrames(frames)
+
+	sf := &tracepb.StackTrace_StackFrames{}
+	module, buildID := loadModuleInfo()
+
+	appendFrame := func(frame runtime.Frame) {
+		sf.Frame = append(sf.Frame, &tracepb.StackTrace_StackFrame{
+			FunctionName:         trunc(frame.Function, 1024),
+			OriginalFunctionName: trunc(frame.Function, 1024),
+			FileName:             trunc(frame.File, 256),
+			LineNumber:           int64(frame.Line),
+			LoadModule: &tracepb.Module{
+				Module:  trunc(module, 256),
+				BuildId: trunc(buildID, 256),
+			},
+		})
+	}
+
+	head, tail, dropped := middleDropPlan(len(frames), maxStackFrames)
+	if dropped > 0 {
+		for _, frame := range frames[:head] {
+			appendFrame(frame)
+		}
+		sf.Frame = append(sf.Frame, &tracepb.StackTrace_StackFrame{
+			FunctionName: trunc(fmt.Sprintf("... %d frames elided ...", dropped), 1024),
+		})
+		for _, frame := range frames[len(frames)-tail:] {
+			appendFrame(frame)
+		}
+	} else {
+		for _, frame := range frames {
+			appendFrame(frame)
+		}
+	}
+	sf.DroppedFramesCount = clip32(dropped)
+
+	// tracepb.StackTrace.StackTraceHashId is int64; hashFrames and
+	// stackTraceCache work in uint64 internally (fnv's native output
+	// type), so the cast happens here, at the single boundary where a
+	// hash crosses into the proto.
+	return &tracepb.StackTrace{StackFrames: sf, StackTraceHashId: int64(hash)}
+}
+
+// middleDropPlan computes how buildStackTrace should truncate a stack of
+// total frames down to at most max: head and tail are the number of
+// frames to keep from the front and back of the stack respectively, and
+// dropped is the number of frames collapsed out of the middle. dropped
+// is 0 (with head and tail unset) when total already fits within max.
+func middleDropPlan(total, max int) (head, tail, dropped int) {
+	if total <= max {
+		return 0, 0, 0
+	}
+	head = max / 2
+	tail = max - head
+	return head, tail, total - head - tail
+}
+
+// hashFrames computes a stable hash of a call stack's function names,
+// file names, and line numbers, suitable for use as a StackTraceHashId.
+func hashFrames(frames []runtime.Frame) uint64 {
+	h := fnv.New64a()
+	for _, frame := range frames {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", frame.Function, frame.File, frame.Line)
+	}
+	return h.Sum64()
+}
+
+var (
+	loadModuleOnce                  sync.Once
+	cachedModuleName, cachedBuildID string
+)
+
+// loadModuleInfo returns the main module's path and a best-effort build
+// identifier, read once from debug.ReadBuildInfo and cached for the
+// lifetime of the process.
+func loadModuleInfo() (module, buildID string) {
+	loadModuleOnce.Do(func() {
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		cachedModuleName = info.Main.Path
+		cachedBuildID = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				cachedBuildID = setting.Value
+				break
+			}
+		}
+	})
+	return cachedModuleName, cachedBuildID
+}
@@ -0,0 +1,256 @@
+// Copyright 2017, OpenCensus Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"runtime"
+	"testing"
+
+	"go.opencensus.io/trace"
+	tracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+)
+
+func TestMiddleDropPlan(t *testing.T) {
+	tests := []struct {
+		total, max           int
+		wantHead, wantTail, wantDropped int
+	}{
+		{total: 10, max: 128, wantHead: 0, wantTail: 0, wantDropped: 0},
+		{total: 128, max: 128, wantHead: 0, wantTail: 0, wantDropped: 0},
+		{total: 129, max: 128, wantHead: 64, wantTail: 64, wantDropped: 1},
+		{total: 201, max: 128, wantHead: 64, wantTail: 64, wantDropped: 73},
+	}
+	for _, tt := range tests {
+		head, tail, dropped := middleDropPlan(tt.total, tt.max)
+		if head != tt.wantHead || tail != tt.wantTail || dropped != tt.wantDropped {
+			t.Errorf("middleDropPlan(%d, %d) = (%d, %d, %d), want (%d, %d, %d)",
+				tt.total, tt.max, head, tail, dropped, tt.wantHead, tt.wantTail, tt.wantDropped)
+		}
+		if dropped == 0 {
+			continue
+		}
+		if kept := head + tail; kept != tt.max {
+			t.Errorf("middleDropPlan(%d, %d) keeps %d frames, want exactly max (%d)", tt.total, tt.max, kept, tt.max)
+		}
+		if head+tail+dropped != tt.total {
+			t.Errorf("middleDropPlan(%d, %d): head+tail+dropped = %d, want total %d", tt.total, tt.max, head+tail+dropped, tt.total)
+		}
+	}
+}
+
+// deepStack recurses depth times before collecting the call stack's
+// program counters, so buildStackTrace has a real stack deeper than
+// maxStackFrames to truncate.
+func deepStack(depth int) []uintptr {
+	if depth == 0 {
+		pcs := make([]uintptr, 256)
+		n := runtime.Callers(0, pcs)
+		return pcs[:n]
+	}
+	return deepStack(depth - 1)
+}
+
+func TestBuildStackTraceMiddleDrop(t *testing.T) {
+	pcs := deepStack(maxStackFrames + 40)
+
+	frameIter := runtime.CallersFrames(pcs)
+	var total int
+	for {
+		_, more := frameIter.Next()
+		total++
+		if !more {
+			break
+		}
+	}
+
+	st := buildStackTrace(pcs)
+	if st.StackFrames == nil {
+		t.Fatal("buildStackTrace returned nil StackFrames")
+	}
+	if total > maxStackFrames {
+		if got, want := len(st.StackFrames.Frame), maxStackFrames+1; got != want {
+			t.Errorf("len(StackFrames.Frame) = %d, want %d (maxStackFrames kept frames + 1 marker)", got, want)
+		}
+		if st.StackFrames.DroppedFramesCount == 0 {
+			t.Error("DroppedFramesCount = 0, want > 0 for a stack deeper than maxStackFrames")
+		}
+	}
+}
+
+func TestDedupeStackTraceWithinBatch(t *testing.T) {
+	pcs := deepStack(5)
+	sp1 := &tracepb.Span{StackTrace: buildStackTrace(pcs)}
+	sp2 := &tracepb.Span{StackTrace: buildStackTrace(pcs)}
+
+	if sp1.StackTrace.StackFrames == nil || sp2.StackTrace.StackFrames == nil {
+		t.Fatal("buildStackTrace should always produce full StackFrames; batch-level dedup happens later")
+	}
+
+	cache := newStackTraceCache()
+	dedupeStackTrace(sp1, cache)
+	dedupeStackTrace(sp2, cache)
+
+	if sp1.StackTrace.StackFrames == nil {
+		t.Error("first occurrence in a batch lost its StackFrames")
+	}
+	if sp2.StackTrace.StackFrames != nil {
+		t.Error("second occurrence of an identical stack in the same batch should be collapsed to a hash reference")
+	}
+	if sp2.StackTrace.StackTraceHashId != sp1.StackTrace.StackTraceHashId {
+		t.Error("collapsed StackTraceHashId should match the first occurrence's hash")
+	}
+
+	// A fresh batch (cache reset) must not still treat this stack as seen,
+	// or Cloud Trace has nothing to resolve the hash reference against.
+	cache.reset()
+	sp3 := &tracepb.Span{StackTrace: buildStackTrace(pcs)}
+	dedupeStackTrace(sp3, cache)
+	if sp3.StackTrace.StackFrames == nil {
+		t.Error("first occurrence in a new batch (after reset) lost its StackFrames")
+	}
+}
+
+func TestCopyAttributesDropsOverCap(t *testing.T) {
+	in := make(map[string]interface{}, maxAttributesPerSpan+8)
+	for i := 0; i < maxAttributesPerSpan+8; i++ {
+		in[string(rune('a'+i/26))+string(rune('a'+i%26))] = int64(i)
+	}
+	var attrs *tracepb.Span_Attributes
+	copyAttributes(&attrs, in, nil)
+
+	if got := len(attrs.AttributeMap); got != maxAttributesPerSpan {
+		t.Errorf("len(AttributeMap) = %d, want %d", got, maxAttributesPerSpan)
+	}
+	if got := attrs.DroppedAttributesCount; got != 8 {
+		t.Errorf("DroppedAttributesCount = %d, want 8", got)
+	}
+}
+
+func TestCopyAttributesAccumulatesDroppedCountAcrossCalls(t *testing.T) {
+	in := make(map[string]interface{}, maxAttributesPerSpan+8)
+	for i := 0; i < maxAttributesPerSpan+8; i++ {
+		in[string(rune('a'+i/26))+string(rune('a'+i%26))] = int64(i)
+	}
+	var attrs *tracepb.Span_Attributes
+	copyAttributes(&attrs, in, nil)
+	if got := attrs.DroppedAttributesCount; got != 8 {
+		t.Fatalf("after first call DroppedAttributesCount = %d, want 8", got)
+	}
+
+	// A second call against the same *out (e.g. to layer a synthetic
+	// attribute on top of a span's real ones) must add to the prior
+	// count, not replace it.
+	copyAttributes(&attrs, map[string]interface{}{"extra": "value"}, nil)
+	if got := attrs.DroppedAttributesCount; got != 9 {
+		t.Errorf("after second call DroppedAttributesCount = %d, want 9 (8 from the first call, plus the new key dropped too)", got)
+	}
+}
+
+func TestCopyAttributesTypeConversions(t *testing.T) {
+	var attrs *tracepb.Span_Attributes
+	copyAttributes(&attrs, map[string]interface{}{
+		"float":     3.7,
+		"bytes":     []byte("hi"),
+		"strings":   []string{"a", "b"},
+		"ints":      []int64{1, 2, 3},
+		"bools":     []bool{true, false},
+		"float64s":  []float64{1.2, 2.8},
+		"unhandled": struct{}{},
+	}, nil)
+
+	get := func(key string) *tracepb.AttributeValue {
+		v, ok := attrs.AttributeMap[key]
+		if !ok {
+			t.Fatalf("AttributeMap[%q] missing", key)
+		}
+		return v
+	}
+	getString := func(key string) string {
+		return get(key).GetStringValue().GetValue()
+	}
+
+	if got := get("float").GetIntValue(); got != 4 {
+		t.Errorf("float -> IntValue = %d, want 4 (rounded)", got)
+	}
+	if got := getString("float.value"); got != "3.7" {
+		t.Errorf(`float.value -> StringValue = %q, want "3.7"`, got)
+	}
+
+	if got := getString("bytes"); got != "aGk=" {
+		t.Errorf("bytes -> StringValue = %q, want base64 %q", got, "aGk=")
+	}
+
+	if got := get("strings.length").GetIntValue(); got != 2 {
+		t.Errorf("strings.length = %d, want 2", got)
+	}
+	if got := getString("strings.0"); got != "a" {
+		t.Errorf("strings.0 = %q, want %q", got, "a")
+	}
+	if got := getString("strings.1"); got != "b" {
+		t.Errorf("strings.1 = %q, want %q", got, "b")
+	}
+
+	if got := get("ints.length").GetIntValue(); got != 3 {
+		t.Errorf("ints.length = %d, want 3", got)
+	}
+	if got := get("ints.2").GetIntValue(); got != 3 {
+		t.Errorf("ints.2 = %d, want 3", got)
+	}
+
+	if got := get("bools.length").GetIntValue(); got != 2 {
+		t.Errorf("bools.length = %d, want 2", got)
+	}
+	if got := get("bools.0").GetBoolValue(); got != true {
+		t.Errorf("bools.0 = %v, want true", got)
+	}
+	if got := get("bools.1").GetBoolValue(); got != false {
+		t.Errorf("bools.1 = %v, want false", got)
+	}
+
+	if got := get("float64s.length").GetIntValue(); got != 2 {
+		t.Errorf("float64s.length = %d, want 2", got)
+	}
+	if got := get("float64s.0").GetIntValue(); got != 1 {
+		t.Errorf("float64s.0 = %d, want 1 (rounded)", got)
+	}
+	if got := get("float64s.1").GetIntValue(); got != 3 {
+		t.Errorf("float64s.1 = %d, want 3 (rounded)", got)
+	}
+
+	if _, ok := attrs.AttributeMap["unhandled"]; ok {
+		t.Error("unhandled value type should be skipped, not added to AttributeMap")
+	}
+}
+
+func TestLinksDroppedLinksCount(t *testing.T) {
+	const numLinks = DefaultMaxLinksPerSpan + 10
+	links := make([]trace.Link, numLinks)
+	s := &trace.SpanData{
+		SpanContext: trace.SpanContext{},
+		Name:        "span",
+		Links:       links,
+	}
+
+	sp := protoFromSpanData(s, "proj", Options{})
+	if sp.Links == nil {
+		t.Fatal("protoFromSpanData did not populate Links")
+	}
+	if got := len(sp.Links.Link); got != DefaultMaxLinksPerSpan {
+		t.Errorf("len(Links.Link) = %d, want %d", got, DefaultMaxLinksPerSpan)
+	}
+	if got := sp.Links.DroppedLinksCount; got != 10 {
+		t.Errorf("DroppedLinksCount = %d, want 10", got)
+	}
+}